@@ -0,0 +1,192 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	prom "github.com/prometheus/client_model/go"
+)
+
+// AggregationMode controls how metrics that share the same name and label
+// set (e.g. the same series scraped from two replicas of an exporter) are
+// combined into a single series.
+type AggregationMode string
+
+const (
+	// AggregateFirst keeps the first metric seen for a given series and
+	// silently drops the rest. This is the historical "Deduplicate"
+	// behaviour.
+	AggregateFirst AggregationMode = "first"
+	// AggregateSum sums series together. This is always used for
+	// counters, untyped metrics and the cumulative parts of histograms
+	// and summaries, and is also available for gauges.
+	AggregateSum AggregationMode = "sum"
+	// AggregateMax keeps the maximum value. Only applies to gauges.
+	AggregateMax AggregationMode = "max"
+	// AggregateMin keeps the minimum value. Only applies to gauges.
+	AggregateMin AggregationMode = "min"
+	// AggregateAvg averages the values. Only applies to gauges.
+	AggregateAvg AggregationMode = "avg"
+)
+
+// aggregateMetricFamily combines metrics that share the same label set
+// within mf according to mode. Counters, untyped metrics, histograms and
+// summaries are always summed regardless of mode (mode only selects the
+// reduction used for gauges), unless mode is AggregateFirst, in which case
+// the first metric of each series is kept and the rest are dropped.
+func aggregateMetricFamily(mode AggregationMode, mf *prom.MetricFamily) *prom.MetricFamily {
+	groups := make(map[string][]*prom.Metric)
+	order := []string{}
+	for _, m := range mf.Metric {
+		signature := labelSignature(m.GetLabel())
+		if _, ok := groups[signature]; !ok {
+			order = append(order, signature)
+		}
+		groups[signature] = append(groups[signature], m)
+	}
+
+	aggregated := make([]*prom.Metric, 0, len(order))
+	for _, signature := range order {
+		aggregated = append(aggregated, aggregateGroup(mode, mf.GetType(), groups[signature]))
+	}
+
+	mf.Metric = aggregated
+	return mf
+}
+
+// aggregateGroup merges metrics that all share the same label set into a
+// single metric.
+func aggregateGroup(mode AggregationMode, metricType prom.MetricType, metrics []*prom.Metric) *prom.Metric {
+	if mode == AggregateFirst || len(metrics) == 1 {
+		return metrics[0]
+	}
+
+	merged := &prom.Metric{
+		Label:       metrics[0].Label,
+		TimestampMs: newestTimestamp(metrics),
+	}
+
+	switch metricType {
+	case prom.MetricType_COUNTER:
+		sum := 0.0
+		for _, m := range metrics {
+			sum += m.GetCounter().GetValue()
+		}
+		merged.Counter = &prom.Counter{Value: &sum}
+	case prom.MetricType_GAUGE:
+		merged.Gauge = &prom.Gauge{Value: aggregateGaugeValues(mode, metrics)}
+	case prom.MetricType_HISTOGRAM:
+		merged.Histogram = aggregateHistograms(metrics)
+	case prom.MetricType_SUMMARY:
+		merged.Summary = aggregateSummaries(metrics)
+	default: // MetricType_UNTYPED
+		sum := 0.0
+		for _, m := range metrics {
+			sum += m.GetUntyped().GetValue()
+		}
+		merged.Untyped = &prom.Untyped{Value: &sum}
+	}
+
+	return merged
+}
+
+func aggregateGaugeValues(mode AggregationMode, metrics []*prom.Metric) *float64 {
+	value := metrics[0].GetGauge().GetValue()
+	for _, m := range metrics[1:] {
+		v := m.GetGauge().GetValue()
+		switch mode {
+		case AggregateMax:
+			if v > value {
+				value = v
+			}
+		case AggregateMin:
+			if v < value {
+				value = v
+			}
+		default: // AggregateSum, AggregateAvg
+			value += v
+		}
+	}
+	if mode == AggregateAvg {
+		value /= float64(len(metrics))
+	}
+	return &value
+}
+
+func aggregateHistograms(metrics []*prom.Metric) *prom.Histogram {
+	var sampleCount uint64
+	var sampleSum float64
+	cumulative := map[float64]uint64{}
+	bounds := []float64{}
+
+	for _, m := range metrics {
+		h := m.GetHistogram()
+		sampleCount += h.GetSampleCount()
+		sampleSum += h.GetSampleSum()
+		for _, b := range h.GetBucket() {
+			ub := b.GetUpperBound()
+			if _, ok := cumulative[ub]; !ok {
+				bounds = append(bounds, ub)
+			}
+			cumulative[ub] += b.GetCumulativeCount()
+		}
+	}
+	sort.Float64s(bounds)
+
+	buckets := make([]*prom.Bucket, 0, len(bounds))
+	for _, ub := range bounds {
+		ub := ub
+		count := cumulative[ub]
+		buckets = append(buckets, &prom.Bucket{
+			UpperBound:      &ub,
+			CumulativeCount: &count,
+		})
+	}
+
+	return &prom.Histogram{
+		SampleCount: &sampleCount,
+		SampleSum:   &sampleSum,
+		Bucket:      buckets,
+	}
+}
+
+// aggregateSummaries sums the sample count and sum across metrics.
+// Quantiles cannot meaningfully be summed, so they are dropped: a merged
+// summary without quantiles is more honest than one with misleading ones.
+func aggregateSummaries(metrics []*prom.Metric) *prom.Summary {
+	var sampleCount uint64
+	var sampleSum float64
+	for _, m := range metrics {
+		s := m.GetSummary()
+		sampleCount += s.GetSampleCount()
+		sampleSum += s.GetSampleSum()
+	}
+	return &prom.Summary{
+		SampleCount: &sampleCount,
+		SampleSum:   &sampleSum,
+	}
+}
+
+func newestTimestamp(metrics []*prom.Metric) *int64 {
+	var newest *int64
+	for _, m := range metrics {
+		if m.TimestampMs == nil {
+			continue
+		}
+		if newest == nil || *m.TimestampMs > *newest {
+			ts := *m.TimestampMs
+			newest = &ts
+		}
+	}
+	return newest
+}
+
+func labelSignature(labels []*prom.LabelPair) string {
+	parts := make([]string, 0, len(labels))
+	for _, label := range labels {
+		parts = append(parts, fmt.Sprintf("%s=%s", label.GetName(), label.GetValue()))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"testing"
+
+	prom "github.com/prometheus/client_model/go"
+)
+
+func f64(v float64) *float64 { return &v }
+func u64(v uint64) *uint64   { return &v }
+
+func labelPair(name, value string) *prom.LabelPair {
+	n, v := name, value
+	return &prom.LabelPair{Name: &n, Value: &v}
+}
+
+func newMetricFamily(t prom.MetricType, metrics ...*prom.Metric) *prom.MetricFamily {
+	name := "test"
+	return &prom.MetricFamily{Name: &name, Type: &t, Metric: metrics}
+}
+
+func TestAggregateMetricFamilyFirst(t *testing.T) {
+	mf := newMetricFamily(prom.MetricType_COUNTER,
+		&prom.Metric{Label: []*prom.LabelPair{labelPair("a", "1")}, Counter: &prom.Counter{Value: f64(1)}},
+		&prom.Metric{Label: []*prom.LabelPair{labelPair("a", "1")}, Counter: &prom.Counter{Value: f64(2)}},
+	)
+
+	got := aggregateMetricFamily(AggregateFirst, mf)
+
+	if len(got.Metric) != 1 {
+		t.Fatalf("expected 1 metric, got %d", len(got.Metric))
+	}
+	if got.Metric[0].GetCounter().GetValue() != 1 {
+		t.Errorf("got %f, want 1 (first occurrence kept)", got.Metric[0].GetCounter().GetValue())
+	}
+}
+
+func TestAggregateMetricFamilyCounter(t *testing.T) {
+	mf := newMetricFamily(prom.MetricType_COUNTER,
+		&prom.Metric{Label: []*prom.LabelPair{labelPair("a", "1")}, Counter: &prom.Counter{Value: f64(1)}},
+		&prom.Metric{Label: []*prom.LabelPair{labelPair("a", "1")}, Counter: &prom.Counter{Value: f64(2)}},
+	)
+
+	got := aggregateMetricFamily(AggregateSum, mf)
+
+	if len(got.Metric) != 1 {
+		t.Fatalf("expected 1 metric, got %d", len(got.Metric))
+	}
+	if v := got.Metric[0].GetCounter().GetValue(); v != 3 {
+		t.Errorf("got %f, want 3", v)
+	}
+}
+
+func TestAggregateMetricFamilyUntyped(t *testing.T) {
+	mf := newMetricFamily(prom.MetricType_UNTYPED,
+		&prom.Metric{Untyped: &prom.Untyped{Value: f64(1)}},
+		&prom.Metric{Untyped: &prom.Untyped{Value: f64(2)}},
+	)
+
+	got := aggregateMetricFamily(AggregateMax, mf)
+
+	if v := got.Metric[0].GetUntyped().GetValue(); v != 3 {
+		t.Errorf("got %f, want 3 (untyped is always summed)", v)
+	}
+}
+
+func TestAggregateMetricFamilyGauge(t *testing.T) {
+	newGauges := func() *prom.MetricFamily {
+		return newMetricFamily(prom.MetricType_GAUGE,
+			&prom.Metric{Gauge: &prom.Gauge{Value: f64(2)}},
+			&prom.Metric{Gauge: &prom.Gauge{Value: f64(4)}},
+		)
+	}
+
+	cases := []struct {
+		mode AggregationMode
+		want float64
+	}{
+		{AggregateSum, 6},
+		{AggregateMax, 4},
+		{AggregateMin, 2},
+		{AggregateAvg, 3},
+	}
+
+	for _, c := range cases {
+		got := aggregateMetricFamily(c.mode, newGauges())
+		if v := got.Metric[0].GetGauge().GetValue(); v != c.want {
+			t.Errorf("mode %s: got %f, want %f", c.mode, v, c.want)
+		}
+	}
+}
+
+func TestAggregateMetricFamilyHistogram(t *testing.T) {
+	bucket := func(ub float64, count uint64) *prom.Bucket {
+		return &prom.Bucket{UpperBound: f64(ub), CumulativeCount: u64(count)}
+	}
+
+	mf := newMetricFamily(prom.MetricType_HISTOGRAM,
+		&prom.Metric{Histogram: &prom.Histogram{
+			SampleCount: u64(2),
+			SampleSum:   f64(3),
+			Bucket:      []*prom.Bucket{bucket(1, 1), bucket(5, 2)},
+		}},
+		&prom.Metric{Histogram: &prom.Histogram{
+			SampleCount: u64(3),
+			SampleSum:   f64(9),
+			Bucket:      []*prom.Bucket{bucket(1, 2), bucket(5, 3)},
+		}},
+	)
+
+	got := aggregateMetricFamily(AggregateSum, mf)
+	h := got.Metric[0].GetHistogram()
+
+	if h.GetSampleCount() != 5 {
+		t.Errorf("sample count: got %d, want 5", h.GetSampleCount())
+	}
+	if h.GetSampleSum() != 12 {
+		t.Errorf("sample sum: got %f, want 12", h.GetSampleSum())
+	}
+	if len(h.GetBucket()) != 2 {
+		t.Fatalf("expected 2 buckets, got %d", len(h.GetBucket()))
+	}
+	if h.GetBucket()[0].GetCumulativeCount() != 3 {
+		t.Errorf("le=1 bucket: got %d, want 3", h.GetBucket()[0].GetCumulativeCount())
+	}
+	if h.GetBucket()[1].GetCumulativeCount() != 5 {
+		t.Errorf("le=5 bucket: got %d, want 5", h.GetBucket()[1].GetCumulativeCount())
+	}
+}
+
+func TestAggregateMetricFamilySummary(t *testing.T) {
+	mf := newMetricFamily(prom.MetricType_SUMMARY,
+		&prom.Metric{Summary: &prom.Summary{
+			SampleCount: u64(2),
+			SampleSum:   f64(3),
+			Quantile:    []*prom.Quantile{{Quantile: f64(0.5), Value: f64(1)}},
+		}},
+		&prom.Metric{Summary: &prom.Summary{
+			SampleCount: u64(4),
+			SampleSum:   f64(7),
+			Quantile:    []*prom.Quantile{{Quantile: f64(0.5), Value: f64(2)}},
+		}},
+	)
+
+	got := aggregateMetricFamily(AggregateSum, mf)
+	s := got.Metric[0].GetSummary()
+
+	if s.GetSampleCount() != 6 {
+		t.Errorf("sample count: got %d, want 6", s.GetSampleCount())
+	}
+	if s.GetSampleSum() != 10 {
+		t.Errorf("sample sum: got %f, want 10", s.GetSampleSum())
+	}
+	if len(s.GetQuantile()) != 0 {
+		t.Errorf("expected quantiles to be dropped, got %d", len(s.GetQuantile()))
+	}
+}
@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func NewRootCommand() *cobra.Command {
+	app := new(App)
+
+	cmd := &cobra.Command{
+		Use:   "exporter-merger",
+		Short: "merges Prometheus metrics from multiple sources",
+		Run:   app.run,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if app.viper.GetBool("verbose") {
+				log.SetLevel(log.DebugLevel)
+			} else {
+				log.SetLevel(log.InfoLevel)
+			}
+		},
+	}
+
+	app.Bind(cmd)
+
+	cmd.AddCommand(NewVersionCommand())
+	cmd.AddCommand(NewPushCommand(app))
+
+	return cmd
+}
+
+type App struct {
+	viper   *viper.Viper
+	targets []Target
+}
+
+func (app *App) Bind(cmd *cobra.Command) {
+	app.viper = viper.New()
+	app.viper.SetEnvPrefix("MERGER")
+	app.viper.AutomaticEnv()
+
+	configPath := cmd.PersistentFlags().StringP(
+		"config-path", "c", "",
+		"Path to the configuration file.")
+	cobra.OnInitialize(func() {
+		if configPath != nil && *configPath != "" {
+			config, err := ReadConfig(*configPath)
+			if err != nil {
+				log.WithField("error", err).Errorf("failed to load config file '%s'", *configPath)
+				os.Exit(1)
+				return
+			}
+			app.targets = config.Targets
+		}
+	})
+
+	cmd.PersistentFlags().Int(
+		"listen-port", 8080,
+		"Listen port for the HTTP server. (ENV:MERGER_PORT)")
+	app.viper.BindPFlag("port", cmd.PersistentFlags().Lookup("listen-port"))
+
+	cmd.PersistentFlags().Int(
+		"exporters-timeout", 10,
+		"HTTP client timeout for connecting to exporters. (ENV:MERGER_EXPORTERSTIMEOUT)")
+	app.viper.BindPFlag("exporterstimeout", cmd.PersistentFlags().Lookup("exporters-timeout"))
+
+	cmd.PersistentFlags().BoolP(
+		"verbose", "v", false,
+		"Include debug messages to output (ENV:MERGER_VERBOSE)")
+	app.viper.BindPFlag("verbose", cmd.PersistentFlags().Lookup("verbose"))
+
+	cmd.PersistentFlags().String(
+		"aggregate", "",
+		"How to combine metrics sharing the same name and labels: first, sum, max, min or avg. Leave empty to keep every duplicate. (ENV:MERGER_AGGREGATE)")
+	app.viper.BindPFlag("aggregate", cmd.PersistentFlags().Lookup("aggregate"))
+
+	cmd.PersistentFlags().StringSlice(
+		"url", nil,
+		"URL to scrape. Can be specified multiple times. Ignored if the --config-path file lists any targets. (ENV:MERGER_URLS,space-seperated)")
+	app.viper.BindPFlag("urls", cmd.PersistentFlags().Lookup("url"))
+
+	cmd.PersistentFlags().String(
+		"federate-path", "/federate",
+		"HTTP path the merged metrics are served on. (ENV:MERGER_FEDERATEPATH)")
+	app.viper.BindPFlag("federatepath", cmd.PersistentFlags().Lookup("federate-path"))
+
+	cmd.PersistentFlags().String(
+		"metrics-path", "/metrics",
+		"HTTP path the merger's own metrics about the merge process are served on. (ENV:MERGER_METRICSPATH)")
+	app.viper.BindPFlag("metricspath", cmd.PersistentFlags().Lookup("metrics-path"))
+
+	cmd.PersistentFlags().Int(
+		"max-concurrency", 10,
+		"Maximum number of targets scraped at the same time. 0 scrapes every target concurrently. (ENV:MERGER_MAXCONCURRENCY)")
+	app.viper.BindPFlag("maxconcurrency", cmd.PersistentFlags().Lookup("max-concurrency"))
+
+	cmd.PersistentFlags().Int(
+		"overall-timeout", 30,
+		"Deadline, in seconds, for a whole federate request regardless of how many targets are slow. 0 disables it. (ENV:MERGER_OVERALLTIMEOUT)")
+	app.viper.BindPFlag("overalltimeout", cmd.PersistentFlags().Lookup("overall-timeout"))
+}
+
+// Targets returns the configured targets, preferring the richer config
+// file format over the flat --url flags when both are set.
+func (app *App) Targets() []Target {
+	if len(app.targets) > 0 {
+		return app.targets
+	}
+
+	urls := app.viper.GetStringSlice("urls")
+	targets := make([]Target, 0, len(urls))
+	for _, u := range urls {
+		targets = append(targets, Target{URL: u})
+	}
+	return targets
+}
+
+// Handler builds the Handler shared by both the HTTP server and the push
+// command, wired up to metrics so either mode reports the same scrape
+// statistics.
+func (app *App) Handler(metrics *Metrics) Handler {
+	return Handler{
+		Targets:              app.Targets(),
+		ExportersHTTPTimeout: app.viper.GetInt("exporterstimeout"),
+		OverallHTTPTimeout:   app.viper.GetInt("overalltimeout"),
+		MaxConcurrency:       app.viper.GetInt("maxconcurrency"),
+		Aggregate:            AggregationMode(app.viper.GetString("aggregate")),
+		Metrics:              metrics,
+	}
+}
+
+func (app *App) run(cmd *cobra.Command, args []string) {
+	metrics := NewMetrics()
+	handler := app.Handler(metrics)
+
+	mux := http.NewServeMux()
+	mux.Handle(app.viper.GetString("federatepath"), handler)
+	mux.Handle(app.viper.GetString("metricspath"), promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+
+	port := app.viper.GetInt("port")
+	log.Infof("starting HTTP server on port %d", port)
+	err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the YAML configuration file format, used when the set of
+// targets is too rich to express as repeated --url flags (static labels,
+// honor_labels, relabel_configs).
+type Config struct {
+	Targets []Target `yaml:"targets"`
+}
+
+func ReadConfig(path string) (*Config, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	config := new(Config)
+	if err := yaml.Unmarshal(raw, config); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", path)
+	}
+
+	log.WithFields(log.Fields{
+		"content": fmt.Sprintf("%#v", config),
+		"path":    path,
+	}).Debug("loaded config file")
+
+	return config, nil
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	prom "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// filterMetricFamilies keeps only the metrics (and, by extension, metric
+// families) that satisfy at least one of matcherSets, mirroring the
+// semantics of Prometheus' own federation endpoint. An empty matcherSets
+// leaves mfs untouched. Families left with no metrics after filtering are
+// dropped entirely so the output stays well-formed.
+func filterMetricFamilies(mfs map[string]*prom.MetricFamily, matcherSets [][]*labels.Matcher) map[string]*prom.MetricFamily {
+	if len(matcherSets) == 0 {
+		return mfs
+	}
+
+	filtered := make(map[string]*prom.MetricFamily, len(mfs))
+	for n, mf := range mfs {
+		metrics := make([]*prom.Metric, 0, len(mf.Metric))
+		for _, m := range mf.Metric {
+			if matchesAny(n, m.GetLabel(), matcherSets) {
+				metrics = append(metrics, m)
+			}
+		}
+		if len(metrics) == 0 {
+			continue
+		}
+		mf.Metric = metrics
+		filtered[n] = mf
+	}
+	return filtered
+}
+
+func matchesAny(name string, labelPairs []*prom.LabelPair, matcherSets [][]*labels.Matcher) bool {
+	for _, matchers := range matcherSets {
+		if matchesAll(name, labelPairs, matchers) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAll(name string, labelPairs []*prom.LabelPair, matchers []*labels.Matcher) bool {
+	values := make(map[string]string, len(labelPairs)+1)
+	values[labels.MetricName] = name
+	for _, l := range labelPairs {
+		values[l.GetName()] = l.GetValue()
+	}
+
+	for _, m := range matchers {
+		if !m.Matches(values[m.Name]) {
+			return false
+		}
+	}
+	return true
+}
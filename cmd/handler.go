@@ -1,23 +1,41 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"sort"
-	"strings"
 	"sync"
 	"time"
 
 	prom "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
 	log "github.com/sirupsen/logrus"
 )
 
+// acceptHeader is sent to downstream exporters so that they may reply with
+// the cheaper-to-parse Protobuf format if they support it, falling back to
+// the text format otherwise.
+const acceptHeader = `application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3`
+
 type Handler struct {
-	Exporters            []string
+	Targets              []Target
 	ExportersHTTPTimeout int
-	Deduplicate          bool
+	// OverallHTTPTimeout bounds the whole merge, in seconds, so a handful
+	// of slow targets can't hold up the response indefinitely. 0 disables
+	// the deadline.
+	OverallHTTPTimeout int
+	// MaxConcurrency caps how many targets are scraped at once. 0 (or
+	// negative) scrapes every target concurrently, matching the
+	// historical behaviour.
+	MaxConcurrency int
+	Aggregate      AggregationMode
+	Metrics        *Metrics
 }
 
 func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -25,98 +43,258 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"RequestURI": r.RequestURI,
 		"UserAgent":  r.UserAgent(),
 	}).Debug("handling new request")
-	h.Merge(w)
-}
 
-func (h Handler) Merge(w io.Writer) {
-	mfs := map[string]*prom.MetricFamily{}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, fmt.Sprintf("error parsing form values: %v", err), http.StatusBadRequest)
+		return
+	}
 
-	responses := make([]map[string]*prom.MetricFamily, 1024)
-	responsesMu := sync.Mutex{}
-	httpClientTimeout := time.Second * time.Duration(h.ExportersHTTPTimeout)
+	var matcherSets [][]*labels.Matcher
+	for _, s := range r.Form["match[]"] {
+		matchers, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
 
-	wg := sync.WaitGroup{}
-	for _, url := range h.Exporters {
-		wg.Add(1)
-		go func(u string) {
-			defer wg.Done()
-			log.WithField("url", u).Debug("getting remote metrics")
-			httpClient := http.Client{Timeout: httpClientTimeout}
-			resp, err := httpClient.Get(u)
-			if err != nil {
-				log.WithField("url", u).Errorf("HTTP connection failed: %v", err)
-				return
-			}
-			defer resp.Body.Close()
+	format := expfmt.Negotiate(r.Header)
+	if f, ok := formatFromQuery(r.Form.Get("format")); ok {
+		format = f
+	}
 
-			tp := new(expfmt.TextParser)
-			part, err := tp.TextToMetricFamilies(resp.Body)
-			if err != nil {
-				log.WithField("url", u).Errorf("Parse response body to metrics: %v", err)
-				return
-			}
-			responsesMu.Lock()
-			responses = append(responses, part)
-			responsesMu.Unlock()
-		}(url)
-	}
-	wg.Wait()
-
-	for _, part := range responses {
-		for n, mf := range part {
-			mfo, ok := mfs[n]
-			if ok {
-				mfo.Metric = append(mfo.Metric, mf.Metric...)
-			} else {
-				mfs[n] = mf
-			}
-		}
+	w.Header().Set("Content-Type", string(format))
+	h.Merge(w, format, matcherSets)
+}
+
+// formatFromQuery maps the "format" query parameter (as used by Prometheus'
+// own federation endpoint) to an expfmt.Format, so that callers that can't
+// set an Accept header can still ask for Protobuf output.
+func formatFromQuery(q string) (expfmt.Format, bool) {
+	switch q {
+	case "protobuf", "proto":
+		return expfmt.FmtProtoDelim, true
+	case "text":
+		return expfmt.FmtText, true
+	default:
+		return "", false
 	}
+}
 
-	if h.Deduplicate {
+func (h Handler) Merge(w io.Writer, format expfmt.Format, matcherSets [][]*labels.Matcher) {
+	ctx := context.Background()
+	if h.OverallHTTPTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Second*time.Duration(h.OverallHTTPTimeout))
+		defer cancel()
+	}
+
+	httpClientTimeout := time.Second * time.Duration(h.ExportersHTTPTimeout)
+	httpClient := http.Client{Timeout: httpClientTimeout}
+
+	mfs := mergeStream(h.scrapeAll(ctx, &httpClient))
+
+	if h.Aggregate != "" {
 		for n, mf := range mfs {
-			mfs[n] = deduplicateMetricFamily(mf)
+			mfs[n] = aggregateMetricFamily(h.Aggregate, mf)
 		}
 	}
 
+	mfs = filterMetricFamilies(mfs, matcherSets)
+
 	names := []string{}
 	for n := range mfs {
 		names = append(names, n)
 	}
 	sort.Strings(names)
 
-	enc := expfmt.NewEncoder(w, expfmt.FmtText)
+	enc := expfmt.NewEncoder(w, format)
 	for _, n := range names {
-		err := enc.Encode(mfs[n])
-		if err != nil {
+		if err := enc.Encode(mfs[n]); err != nil {
+			log.Error(err)
+			return
+		}
+	}
+	if closer, ok := enc.(expfmt.Closer); ok {
+		if err := closer.Close(); err != nil {
 			log.Error(err)
+		}
+	}
+}
+
+// scrapeAll fans the configured targets out to a worker pool bounded by
+// MaxConcurrency, streaming each resulting metric family onto the returned
+// channel as soon as it's ready, rather than buffering every target's full
+// response in memory before merging anything.
+func (h Handler) scrapeAll(ctx context.Context, httpClient *http.Client) <-chan *prom.MetricFamily {
+	families := make(chan *prom.MetricFamily)
+
+	workers := h.MaxConcurrency
+	if workers <= 0 || workers > len(h.Targets) {
+		workers = len(h.Targets)
+	}
+	if workers == 0 {
+		close(families)
+		return families
+	}
+
+	jobs := make(chan Target)
+	go func() {
+		defer close(jobs)
+		for _, target := range h.Targets {
+			select {
+			case jobs <- target:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range jobs {
+				h.scrapeOne(ctx, httpClient, target, families)
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(families)
+	}()
+
+	return families
+}
+
+// scrapeOne scrapes a single target, applies its labels and relabel
+// pipeline, and sends every resulting metric family onto out.
+func (h Handler) scrapeOne(ctx context.Context, httpClient *http.Client, target Target, out chan<- *prom.MetricFamily) {
+	log.WithField("url", target.URL).Debug("getting remote metrics")
+
+	part, err := fetchMetricFamilies(ctx, httpClient, h.Metrics, target.URL)
+	if err != nil {
+		log.WithField("url", target.URL).Errorf("failed to fetch metrics: %v", err)
+		return
+	}
+
+	for _, mf := range applyTarget(target, part) {
+		select {
+		case out <- mf:
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func deduplicateMetricFamily(mf *prom.MetricFamily) *prom.MetricFamily {
-	seen := make(map[string]bool)
-	deduplicated := make([]*prom.Metric, 0, len(mf.Metric))
+// mergeStream drains families, combining metrics that share a family name.
+func mergeStream(families <-chan *prom.MetricFamily) map[string]*prom.MetricFamily {
+	mfs := map[string]*prom.MetricFamily{}
+	for mf := range families {
+		n := mf.GetName()
+		if existing, ok := mfs[n]; ok {
+			existing.Metric = append(existing.Metric, mf.Metric...)
+		} else {
+			mfs[n] = mf
+		}
+	}
+	return mfs
+}
+
+// fetchMetricFamilies scrapes a single exporter, asking for either the text
+// or the Protobuf exposition format and parsing whichever one the exporter
+// actually replies with. It records the outcome on metrics so a broken
+// exporter is visible as more than just a log line.
+func fetchMetricFamilies(ctx context.Context, httpClient *http.Client, metrics *Metrics, u string) (map[string]*prom.MetricFamily, error) {
+	start := time.Now()
 
-	for _, m := range mf.Metric {
-		signature := labelSignature(m.GetLabel())
-		if seen[signature] {
-			continue
+	mfs, err := doFetchMetricFamilies(ctx, httpClient, u)
+	duration := time.Since(start).Seconds()
+	if err != nil {
+		metrics.observeFailure(u, duration, scrapeFailureReason(err))
+		return nil, err
+	}
+
+	samples := 0
+	for _, mf := range mfs {
+		samples += len(mf.Metric)
+	}
+	metrics.observeSuccess(u, duration, samples)
+	return mfs, nil
+}
+
+func doFetchMetricFamilies(ctx context.Context, httpClient *http.Client, u string) (map[string]*prom.MetricFamily, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", acceptHeader)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{statusCode: resp.StatusCode}
+	}
+
+	dec := expfmt.NewDecoder(resp.Body, expfmt.ResponseFormat(resp.Header))
+
+	mfs := map[string]*prom.MetricFamily{}
+	for {
+		mf := &prom.MetricFamily{}
+		if err := dec.Decode(mf); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, &parseError{err: err}
 		}
-		seen[signature] = true
-		deduplicated = append(deduplicated, m)
+		mfs[mf.GetName()] = mf
 	}
+	return mfs, nil
+}
+
+// httpStatusError and parseError let scrapeFailureReason tell a non-200
+// response apart from a connection error and a malformed response body
+// apart from both, without resorting to string matching on err.Error().
+type httpStatusError struct {
+	statusCode int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d", e.statusCode)
+}
 
-	mf.Metric = deduplicated
-	return mf
+type parseError struct {
+	err error
 }
 
-func labelSignature(labels []*prom.LabelPair) string {
-	parts := make([]string, 0, len(labels))
-	for _, label := range labels {
-		parts = append(parts, fmt.Sprintf("%s=%s", label.GetName(), label.GetValue()))
+func (e *parseError) Error() string {
+	return fmt.Sprintf("parse response body to metrics: %v", e.err)
+}
+
+func (e *parseError) Unwrap() error {
+	return e.err
+}
+
+func scrapeFailureReason(err error) string {
+	var statusErr *httpStatusError
+	var parseErr *parseError
+	netErr := net.Error(nil)
+
+	switch {
+	case errors.As(err, &statusErr):
+		return ScrapeFailureHTTPStatus
+	case errors.As(err, &parseErr):
+		return ScrapeFailureParse
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ScrapeFailureTimeout
+	default:
+		return ScrapeFailureConnect
 	}
-	sort.Strings(parts)
-	return strings.Join(parts, ",")
 }
@@ -0,0 +1,84 @@
+package cmd
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Reasons a scrape of an exporter can fail, used to label
+// ScrapeFailuresTotal so operators can tell a DNS/connect problem apart
+// from a slow exporter or one that returns garbage.
+const (
+	ScrapeFailureConnect    = "connect"
+	ScrapeFailureTimeout    = "timeout"
+	ScrapeFailureHTTPStatus = "http_status"
+	ScrapeFailureParse      = "parse"
+)
+
+// Metrics holds the self-monitoring instrumentation for the merge process.
+// Without it a broken exporter is only visible as a log line and the
+// merged output just silently degrades; registering these under their own
+// endpoint lets operators alert on partial failures instead.
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	ScrapesTotal        *prometheus.CounterVec
+	ScrapeFailuresTotal *prometheus.CounterVec
+	ScrapeDuration      *prometheus.HistogramVec
+	LastScrapeSamples   *prometheus.GaugeVec
+	Up                  *prometheus.GaugeVec
+}
+
+// NewMetrics creates and registers the self-monitoring metrics.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		ScrapesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "exporter_merger_scrapes_total",
+			Help: "Total number of scrapes of an exporter.",
+		}, []string{"url"}),
+		ScrapeFailuresTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "exporter_merger_scrape_failures_total",
+			Help: "Total number of failed scrapes of an exporter, by reason.",
+		}, []string{"url", "reason"}),
+		ScrapeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "exporter_merger_scrape_duration_seconds",
+			Help: "Duration of scraping a single exporter.",
+		}, []string{"url"}),
+		LastScrapeSamples: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "exporter_merger_last_scrape_samples",
+			Help: "Number of samples returned by the last successful scrape of an exporter.",
+		}, []string{"url"}),
+		Up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "exporter_merger_up",
+			Help: "Whether the last scrape of the exporter succeeded (1) or not (0).",
+		}, []string{"url"}),
+	}
+
+	m.Registry.MustRegister(
+		m.ScrapesTotal,
+		m.ScrapeFailuresTotal,
+		m.ScrapeDuration,
+		m.LastScrapeSamples,
+		m.Up,
+	)
+
+	return m
+}
+
+func (m *Metrics) observeSuccess(url string, duration float64, samples int) {
+	if m == nil {
+		return
+	}
+	m.ScrapesTotal.WithLabelValues(url).Inc()
+	m.ScrapeDuration.WithLabelValues(url).Observe(duration)
+	m.LastScrapeSamples.WithLabelValues(url).Set(float64(samples))
+	m.Up.WithLabelValues(url).Set(1)
+}
+
+func (m *Metrics) observeFailure(url string, duration float64, reason string) {
+	if m == nil {
+		return
+	}
+	m.ScrapesTotal.WithLabelValues(url).Inc()
+	m.ScrapeDuration.WithLabelValues(url).Observe(duration)
+	m.ScrapeFailuresTotal.WithLabelValues(url, reason).Inc()
+	m.Up.WithLabelValues(url).Set(0)
+}
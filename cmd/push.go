@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// NewPushCommand builds the "push" subcommand, an alternative to serving
+// /federate: instead of waiting to be scraped, the merger scrapes its
+// targets itself on a fixed interval and pushes the merged result to a
+// Pushgateway.
+func NewPushCommand(app *App) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "push",
+		Short: "periodically pushes merged metrics to a Pushgateway",
+		Run:   app.push,
+	}
+
+	cmd.Flags().String(
+		"pushgateway-url", "",
+		"Base URL of the Pushgateway to push merged metrics to, e.g. http://pushgateway:9091. (ENV:MERGER_PUSHGATEWAYURL)")
+	app.viper.BindPFlag("pushgatewayurl", cmd.Flags().Lookup("pushgateway-url"))
+
+	cmd.Flags().String(
+		"job", "exporter-merger",
+		"Value of the \"job\" grouping key the merged metrics are pushed under. (ENV:MERGER_JOB)")
+	app.viper.BindPFlag("job", cmd.Flags().Lookup("job"))
+
+	cmd.Flags().String(
+		"instance", "",
+		"Value of the \"instance\" grouping key the merged metrics are pushed under. Omitted if empty. (ENV:MERGER_INSTANCE)")
+	app.viper.BindPFlag("instance", cmd.Flags().Lookup("instance"))
+
+	cmd.Flags().Int(
+		"push-interval", 15,
+		"How often, in seconds, to scrape the targets and push the result. (ENV:MERGER_PUSHINTERVAL)")
+	app.viper.BindPFlag("pushinterval", cmd.Flags().Lookup("push-interval"))
+
+	cmd.Flags().Int(
+		"push-retries", 3,
+		"Number of times to retry a push after a non-2xx response, with exponential backoff. (ENV:MERGER_PUSHRETRIES)")
+	app.viper.BindPFlag("pushretries", cmd.Flags().Lookup("push-retries"))
+
+	return cmd
+}
+
+func (app *App) push(cmd *cobra.Command, args []string) {
+	pgwURL := app.viper.GetString("pushgatewayurl")
+	if pgwURL == "" {
+		log.Fatal("--pushgateway-url is required")
+	}
+
+	metrics := NewMetrics()
+	pusher := Pusher{
+		Handler:    app.Handler(metrics),
+		URL:        pgwURL,
+		Job:        app.viper.GetString("job"),
+		Instance:   app.viper.GetString("instance"),
+		Interval:   time.Second * time.Duration(app.viper.GetInt("pushinterval")),
+		MaxRetries: app.viper.GetInt("pushretries"),
+	}
+
+	pusher.Run()
+}
+
+// Pusher periodically merges the configured targets and pushes the result
+// to a Pushgateway, rather than waiting to be scraped.
+type Pusher struct {
+	Handler    Handler
+	URL        string
+	Job        string
+	Instance   string
+	Interval   time.Duration
+	MaxRetries int
+}
+
+// Run blocks forever, pushing once immediately and then once per Interval.
+func (p Pusher) Run() {
+	groupingURL := p.groupingURL()
+	log.WithFields(log.Fields{
+		"url":      groupingURL,
+		"interval": p.Interval,
+	}).Info("starting push loop")
+
+	for {
+		if err := p.pushOnce(groupingURL); err != nil {
+			log.Errorf("failed to push metrics: %v", err)
+		}
+		time.Sleep(p.Interval)
+	}
+}
+
+// groupingURL builds the Pushgateway grouping key URL of the form
+// <pgw>/metrics/job/<job>[/instance/<instance>].
+func (p Pusher) groupingURL() string {
+	u := strings.TrimRight(p.URL, "/") + "/metrics/job/" + url.PathEscape(p.Job)
+	if p.Instance != "" {
+		u += "/instance/" + url.PathEscape(p.Instance)
+	}
+	return u
+}
+
+// pushOnce merges the configured targets once and PUTs the result to the
+// Pushgateway, retrying with exponential backoff on a non-2xx response.
+func (p Pusher) pushOnce(groupingURL string) error {
+	buf := &bytes.Buffer{}
+	p.Handler.Merge(buf, expfmt.FmtProtoDelim, nil)
+	body := buf.Bytes()
+
+	var lastErr error
+	for attempt := 0; attempt <= p.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Second * time.Duration(1<<uint(attempt-1)))
+		}
+
+		req, err := http.NewRequest(http.MethodPut, groupingURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		lastErr = fmt.Errorf("unexpected status code %d from pushgateway", resp.StatusCode)
+	}
+
+	return lastErr
+}
@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"sort"
+
+	prom "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+)
+
+// Target describes a single exporter to scrape, along with how its metrics
+// should be labelled and relabelled before being merged with everyone
+// else's. This mirrors the target-level knobs Prometheus itself offers
+// (`honor_labels`, static labels, `relabel_configs`), so that merging
+// several instances of the same exporter doesn't collide on identical
+// label sets.
+type Target struct {
+	URL         string            `yaml:"url"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	HonorLabels bool              `yaml:"honor_labels,omitempty"`
+	Relabel     []*relabel.Config `yaml:"relabel_configs,omitempty"`
+}
+
+// applyTarget injects the target's static labels and runs the relabel
+// pipeline over every metric scraped from it, grouping the result back
+// into metric families (a relabel rule touching "__name__" can move a
+// metric into a different family). Metrics dropped by the relabel
+// pipeline are omitted from the result.
+func applyTarget(target Target, part map[string]*prom.MetricFamily) map[string]*prom.MetricFamily {
+	if len(target.Labels) == 0 && len(target.Relabel) == 0 {
+		return part
+	}
+
+	out := map[string]*prom.MetricFamily{}
+	for name, mf := range part {
+		for _, m := range mf.Metric {
+			newName, ok := relabelMetric(name, m, target)
+			if !ok {
+				continue
+			}
+
+			dst, ok := out[newName]
+			if !ok {
+				dst = &prom.MetricFamily{
+					Name: &newName,
+					Help: mf.Help,
+					Type: mf.Type,
+				}
+				out[newName] = dst
+			}
+			dst.Metric = append(dst.Metric, m)
+		}
+	}
+	return out
+}
+
+// relabelMetric applies honor_labels semantics for the target's static
+// labels and then the relabel pipeline to a single metric, returning the
+// (possibly new) metric family name it belongs to, or ok=false if the
+// relabel pipeline dropped it.
+func relabelMetric(name string, m *prom.Metric, target Target) (string, bool) {
+	injectTargetLabels(m, target)
+
+	ls := make(labels.Labels, 0, len(m.Label)+1)
+	ls = append(ls, labels.Label{Name: labels.MetricName, Value: name})
+	for _, l := range m.Label {
+		ls = append(ls, labels.Label{Name: l.GetName(), Value: l.GetValue()})
+	}
+	ls = labels.New(ls...)
+
+	if len(target.Relabel) > 0 {
+		ls = relabel.Process(ls, target.Relabel...)
+		if ls == nil {
+			return "", false
+		}
+	}
+
+	newName := name
+	newLabels := make([]*prom.LabelPair, 0, len(ls))
+	for _, l := range ls {
+		if l.Name == labels.MetricName {
+			newName = l.Value
+			continue
+		}
+		n, v := l.Name, l.Value
+		newLabels = append(newLabels, &prom.LabelPair{Name: &n, Value: &v})
+	}
+	m.Label = newLabels
+
+	return newName, true
+}
+
+// injectTargetLabels adds the target's static labels to m, following
+// Prometheus' honor_labels semantics: when honor_labels is false, the
+// target label wins on conflict and the scraped label is kept around
+// renamed to "exported_<name>"; when true, the scraped label wins and the
+// target label is dropped for that metric.
+func injectTargetLabels(m *prom.Metric, target Target) {
+	if len(target.Labels) == 0 {
+		return
+	}
+
+	existing := make(map[string]*prom.LabelPair, len(m.Label))
+	for _, l := range m.Label {
+		existing[l.GetName()] = l
+	}
+
+	names := make([]string, 0, len(target.Labels))
+	for n := range target.Labels {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		v := target.Labels[n]
+		if l, ok := existing[n]; ok {
+			if target.HonorLabels {
+				continue
+			}
+			exported := "exported_" + n
+			l.Name = &exported
+		}
+		name, value := n, v
+		m.Label = append(m.Label, &prom.LabelPair{Name: &name, Value: &value})
+	}
+}
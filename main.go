@@ -0,0 +1,12 @@
+package main
+
+import (
+	"github.com/kaidotdev/exporter-merger/cmd"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	if err := cmd.NewRootCommand().Execute(); err != nil {
+		log.Fatal(err)
+	}
+}